@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// blobStore is a content-addressed store of response bodies: each distinct
+// body is written once, at <root>/blobs/<first two hex chars of its
+// SHA-256>/<full hex digest>.
+type blobStore struct {
+	mu   sync.Mutex
+	root string
+	seen map[string]bool
+}
+
+func newBlobStore(root string) *blobStore {
+	return &blobStore{root: root, seen: make(map[string]bool)}
+}
+
+// put writes body under its content hash, skipping the write if that hash
+// is already on disk, and returns the hex-encoded digest.
+func (bs *blobStore) put(body []byte) (string, error) {
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.seen[hash] {
+		return hash, nil
+	}
+
+	dir := filepath.Join(bs.root, "blobs", hash[:2])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating blob dir %v: %v", dir, err)
+	}
+
+	path := filepath.Join(dir, hash)
+	if _, err := os.Stat(path); err == nil {
+		bs.seen[hash] = true
+		return hash, nil
+	}
+
+	if err := ioutil.WriteFile(path, body, 0644); err != nil {
+		return "", fmt.Errorf("error writing blob %v: %v", path, err)
+	}
+	bs.seen[hash] = true
+	return hash, nil
+}
+
+// copyInto ensures bs's blob for hash also exists under dir/blobs/, so an
+// archive zipped from dir is self-contained even when bs is the shared
+// -dedup=global store rooted elsewhere. A no-op once dir already is bs's
+// root, which is always true for -dedup=per-file.
+func (bs *blobStore) copyInto(dir, hash string) error {
+	srcPath := filepath.Join(bs.root, "blobs", hash[:2], hash)
+	dstPath := filepath.Join(dir, "blobs", hash[:2], hash)
+	if srcPath == dstPath {
+		return nil
+	}
+	if _, err := os.Stat(dstPath); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("error creating blob dir %v: %v", filepath.Dir(dstPath), err)
+	}
+
+	body, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return fmt.Errorf("error reading blob %v: %v", srcPath, err)
+	}
+	if err := ioutil.WriteFile(dstPath, body, 0644); err != nil {
+		return fmt.Errorf("error writing blob %v: %v", dstPath, err)
+	}
+	return nil
+}
+
+// manifestEntry is one line of <dir>/manifest.jsonl: a fetched URL, the
+// content hash its body was stored under, and the response metadata
+// needed to make sense of it without re-fetching.
+type manifestEntry struct {
+	URL         string    `json:"url"`
+	Hash        string    `json:"hash"`
+	Status      int       `json:"status"`
+	FetchedAt   time.Time `json:"fetched_at"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int       `json:"size"`
+}
+
+// newDedupResultHandler returns the streaming fetchAll onResult callback and
+// cleanup func handleFileZip uses for -dedup=per-file/global, plus its
+// cleanup func. store is a shared, run-wide blobStore for -dedup=global, or
+// one scoped to this file for -dedup=per-file. Each body is hashed, stored,
+// and appended to <dir>/manifest.jsonl as its fetch completes, rather than
+// once the whole file is done; the manifest is opened for append rather
+// than truncated so a resumed run doesn't lose a prior, interrupted run's
+// entries.
+func newDedupResultHandler(dir string, state *crawlState, store *blobStore) (func(fetchResult), func(), error) {
+	path := filepath.Join(dir, "manifest.jsonl")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening manifest %v: %v", path, err)
+	}
+	enc := json.NewEncoder(f)
+
+	onResult := func(res fetchResult) {
+		if res.Err != nil {
+			return
+		}
+
+		hash, err := store.put(res.Body)
+		if err != nil {
+			appLogger.Error(err.Error(), Fields{"url": res.URL})
+			atomic.AddInt64(&totalErrs, 1)
+			return
+		}
+		if err := store.copyInto(dir, hash); err != nil {
+			appLogger.Error(err.Error(), Fields{"url": res.URL, "hash": hash})
+			atomic.AddInt64(&totalErrs, 1)
+			return
+		}
+		state.setFile(res.URL, hash)
+
+		entry := manifestEntry{URL: res.URL, Hash: hash, Size: len(res.Body), FetchedAt: time.Now().UTC()}
+		if res.Response != nil {
+			entry.Status = res.Response.StatusCode
+			entry.ContentType = res.Response.Header.Get("Content-Type")
+		}
+		if err := enc.Encode(entry); err != nil {
+			appLogger.Error(fmt.Sprintf("error writing manifest entry: %v", err), Fields{"url": res.URL})
+			atomic.AddInt64(&totalErrs, 1)
+		}
+	}
+
+	return onResult, func() { f.Close() }, nil
+}
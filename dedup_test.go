@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlobStorePutIsContentAddressedAndIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	bs := newBlobStore(dir)
+
+	hash1, err := bs.put([]byte("hello"))
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	hash2, err := bs.put([]byte("hello"))
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if hash1 != hash2 {
+		t.Errorf("expected identical bodies to hash the same, got %v and %v", hash1, hash2)
+	}
+
+	path := filepath.Join(dir, "blobs", hash1[:2], hash1)
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected blob at %v: %v", path, err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("blob contents = %q, want %q", body, "hello")
+	}
+}
+
+func TestBlobStorePutDistinctBodiesGetDistinctHashes(t *testing.T) {
+	dir := t.TempDir()
+	bs := newBlobStore(dir)
+
+	hash1, _ := bs.put([]byte("hello"))
+	hash2, _ := bs.put([]byte("goodbye"))
+	if hash1 == hash2 {
+		t.Error("expected distinct bodies to hash differently")
+	}
+}
+
+func TestBlobStoreCopyIntoIsNoopForOwnRoot(t *testing.T) {
+	dir := t.TempDir()
+	bs := newBlobStore(dir)
+	hash, err := bs.put([]byte("hello"))
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	if err := bs.copyInto(dir, hash); err != nil {
+		t.Fatalf("copyInto: %v", err)
+	}
+}
+
+func TestBlobStoreCopyIntoCopiesFromSharedRoot(t *testing.T) {
+	root := t.TempDir()
+	bs := newBlobStore(root)
+	hash, err := bs.put([]byte("hello"))
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	dest := t.TempDir()
+	if err := bs.copyInto(dest, hash); err != nil {
+		t.Fatalf("copyInto: %v", err)
+	}
+
+	path := filepath.Join(dest, "blobs", hash[:2], hash)
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected copied blob at %v: %v", path, err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("copied blob contents = %q, want %q", body, "hello")
+	}
+}
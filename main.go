@@ -3,27 +3,43 @@ package main
 import (
 	"archive/zip"
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/http/httputil"
+	neturl "net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const defaultUserAgent = "webscraper/1.0 (+https://github.com/SHDavies/webscraper)"
+
 var (
 	reqThreads       *int
-	logger           *log.Logger
-	logFile          *os.File
-	total            int
-	totalErrs        int
+	appLogger        *structuredLogger
+	total            int64
+	totalErrs        int64
 	timeoutThreshold *int
 	quiet            *bool
+	format           *string
+	maxAttempts      *int
+	progress         *progressManager
+	politenessCtl    *politeness
+	retries          *int
+	retryBase        *time.Duration
+	retryCap         *time.Duration
+	dedupMode        *string
+	globalBlobStore  *blobStore
 )
 
 func main() {
@@ -32,25 +48,65 @@ func main() {
 	pageThreads := flag.Int("p", 4, "Number of pages to work on concurrently")
 	timeoutThreshold = flag.Int("t", 10, "Seconds to allow http requests before aborting")
 	quiet = flag.Bool("q", false, "Don't log http requests")
+	format = flag.String("format", "zip", "Output format for fetched pages: zip or warc")
+	maxAttempts = flag.Int("max-attempts", 3, "Maximum fetch attempts for a URL before it's given up on")
+	logLevel := flag.String("log-level", "info", "Minimum level to log: debug, info, warn, or error")
+	logFormat := flag.String("log-format", "text", "Log line format: text or json")
+	logFilePath := flag.String("log-file", "webcrawl.log", "File to write structured logs to")
+	logMaxSizeMB := flag.Int64("log-max-size", 10, "Rotate the log file once it exceeds this many megabytes")
+	progressFlag := flag.Bool("progress", false, "Show a live multi-bar progress UI (mutually exclusive with -q)")
+	perHost := flag.Int("per-host", 2, "Max in-flight requests to any single host")
+	delay := flag.Duration("delay", 0, "Minimum delay between requests to the same host, e.g. 500ms")
+	delayJitter := flag.Duration("delay-jitter", 0, "Maximum random jitter added on top of -delay")
+	userAgent := flag.String("user-agent", defaultUserAgent, "User-Agent header sent with every request and matched against robots.txt")
+	ignoreRobots := flag.Bool("ignore-robots", false, "Fetch urls even if robots.txt disallows them for -user-agent")
+	retries = flag.Int("retries", 2, "Number of retries for retryable failures (network errors, 429, 5xx)")
+	retryBase = flag.Duration("retry-base", 500*time.Millisecond, "Base delay for exponential backoff between retries")
+	retryCap = flag.Duration("retry-cap", 30*time.Second, "Maximum delay between retries")
+	dedupMode = flag.String("dedup", "none", "Deduplicate fetched bodies by content hash: none, per-file, or global")
 	flag.Parse()
 
-	// Queue for concurrent .txt files
-	pageQueue := make(chan struct{}, *pageThreads)
-	start := time.Now()
+	if *progressFlag && *quiet {
+		log.Fatalln(fmt.Errorf("-progress and -q are mutually exclusive"))
+	}
+
+	switch *dedupMode {
+	case "none", "per-file", "global":
+	default:
+		log.Fatalln(fmt.Errorf("invalid -dedup %q: must be none, per-file, or global", *dedupMode))
+	}
+
+	// Snapshotted before creating any output files (log file, blob store,
+	// etc.) in cwd, so none of our own output is later picked up and
+	// mistaken for an input crawl list.
 	thisDir, err := ioutil.ReadDir(".")
 	if err != nil {
 		log.Fatalln(fmt.Errorf("error reading dir: %v", err))
 	}
 
-	// Create log file if it doesn't exist
-	logFile, err = os.Open("webcrawl.log")
+	level, err := parseLevel(*logLevel)
 	if err != nil {
-		logFile, err = os.Create("webcrawl.log")
-		if err != nil {
-			log.Fatalln(fmt.Errorf("error creating log file: %v", err))
-		}
+		log.Fatalln(err)
 	}
-	logger = log.New(logFile, "ERROR: ", log.LstdFlags)
+
+	appLogger, err = newStructuredLogger(*logFilePath, level, *logFormat, *logMaxSizeMB*1024*1024)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if *progressFlag {
+		progress = newProgressManager()
+	}
+
+	politenessCtl = newPoliteness(*perHost, *delay, *delayJitter, *userAgent, *ignoreRobots)
+
+	if *dedupMode == "global" {
+		globalBlobStore = newBlobStore(".")
+	}
+
+	// Queue for concurrent .txt files
+	pageQueue := make(chan struct{}, *pageThreads)
+	start := time.Now()
 
 	// WaitGroup ensures program waits for all goroutines before printing stats and exiting
 	var wg sync.WaitGroup
@@ -65,8 +121,8 @@ func main() {
 				err = handleFile(file.Name())
 				if err != nil {
 					fmt.Println(err)
-					logger.Println(err)
-					totalErrs++
+					appLogger.Error(err.Error(), Fields{"file": file.Name()})
+					atomic.AddInt64(&totalErrs, 1)
 				}
 				// Release spot in queue
 				<-pageQueue
@@ -78,138 +134,448 @@ func main() {
 
 	// Wait for all goroutines then print stats and exit
 	wg.Wait()
+	progress.close()
 	close(pageQueue)
-	fmt.Printf("TOTAL FILES FETCHED: %v\n", total)
-	fmt.Printf("TOTAL ERRORS (check webcrawl.log for info): %v\n", totalErrs)
+	fmt.Printf("TOTAL FILES FETCHED: %v\n", atomic.LoadInt64(&total))
+	fmt.Printf("TOTAL ERRORS (check %v for info): %v\n", *logFilePath, atomic.LoadInt64(&totalErrs))
 	fmt.Printf("TOTAL TIME: %v\n", time.Since(start))
 }
 
+// handleFile reads the URLs listed in fname (one per line) and fetches them,
+// writing the results out in the format selected by -format. Progress is
+// tracked in a <name>.state file so a killed and rerun crawl skips whatever
+// it already finished.
 func handleFile(fname string) error {
 	fmt.Println("------->", fname)
-	// Open .txt file
+
 	file, err := os.Open(fname)
 	if err != nil {
 		return fmt.Errorf("error opening file: %v", err)
 	}
 	defer file.Close()
 
-	// Make new dir for .html files and index
 	name := strings.Split(fname, ".")[0]
-	err = os.Mkdir(name, 0755)
+
+	var urls []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		urls = append(urls, scanner.Text())
+	}
+
+	state, err := loadCrawlState(name+".state", urls)
+	if err != nil {
+		return fmt.Errorf("error loading state for %v: %v", name, err)
+	}
+	defer state.Flush()
+
+	// Registered with a total of 0 for now: fetchAll fills in the real total
+	// once it's filtered urls down to the ones it'll actually attempt.
+	progress.addFile(name, 0)
+	defer progress.removeFile(name)
+
+	switch *format {
+	case "warc":
+		return handleFileWarc(name, urls, state)
+	default:
+		return handleFileZip(name, urls, state)
+	}
+}
+
+// handleFileZip fetches urls and archives the results under <name>/, then
+// zips the directory up as <name>.zip. With -dedup=none (the default) that
+// means <name>/N.html files plus an index.txt mapping url -> filename; with
+// -dedup=per-file or -dedup=global it means a manifest.jsonl mapping url ->
+// content hash, with bodies stored once per hash in a blobs/ directory.
+func handleFileZip(name string, urls []string, state *crawlState) error {
+	if err := restoreZipWorkingDir(name); err != nil {
+		return err
+	}
+
+	onResult, cleanup, err := newResultHandler(name, state)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	fetchAll(urls, state, name, onResult)
+
+	err = zipit(name, name+".zip")
+	if err != nil {
+		return fmt.Errorf("error creating zip: %v", err)
+	}
+
+	err = os.RemoveAll(name)
+	if err != nil {
+		return fmt.Errorf("error deleting directory %v: %v", name, err)
+	}
+
+	return nil
+}
+
+// newResultHandler returns the streaming fetchAll onResult callback
+// handleFileZip uses, chosen by -dedup, plus a cleanup func to call once
+// fetchAll returns. Each body is written to disk (or handed to a blobStore)
+// as soon as its fetch completes, rather than held in memory for the life
+// of the whole input file.
+func newResultHandler(name string, state *crawlState) (func(fetchResult), func(), error) {
+	switch *dedupMode {
+	case "global":
+		return newDedupResultHandler(name, state, globalBlobStore)
+	case "per-file":
+		return newDedupResultHandler(name, state, newBlobStore(name))
+	default:
+		return newFlatResultHandler(name, state)
+	}
+}
+
+// newFlatResultHandler streams each fetched body to <name>/N.html, appending
+// a matching line to <name>/index.txt.
+func newFlatResultHandler(name string, state *crawlState) (func(fetchResult), func(), error) {
+	urlCount := nextHTMLIndex(name)
+	index, err := os.OpenFile(filepath.Join(name, "index.txt"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		return fmt.Errorf("error creating dir %v: %v", name, err)
+		return nil, nil, fmt.Errorf("error opening index.txt: %v", err)
+	}
+
+	onResult := func(res fetchResult) {
+		if res.Err != nil {
+			return
+		}
+
+		newFileName := fmt.Sprint(urlCount) + ".html"
+		urlCount++
+
+		if err := ioutil.WriteFile(filepath.Join(name, newFileName), res.Body, 0644); err != nil {
+			appLogger.Error(err.Error(), Fields{"url": res.URL, "file": newFileName})
+			atomic.AddInt64(&totalErrs, 1)
+			return
+		}
+		index.WriteString(fmt.Sprintf("%v, %v\n", res.URL, newFileName))
+		state.setFile(res.URL, newFileName)
+	}
+
+	return onResult, func() { index.Close() }, nil
+}
+
+// restoreZipWorkingDir ensures <name>/ exists and, if a crawl was
+// interrupted and rerun, contains whatever was already written to it. A run
+// that finished successfully removes name/ after zipping it up, so on
+// resume the directory is missing and its contents have to come back out of
+// <name>.zip; a run that was killed mid-fetch leaves name/ in place, in
+// which case there's nothing to restore. Without this, a resumed crawl
+// would start its working directory empty and ship an archive missing every
+// page fetched in the prior session.
+func restoreZipWorkingDir(name string) error {
+	if _, err := os.Stat(name); err == nil {
+		return nil
 	}
 
-	// Create index file
-	index, err := os.Create(filepath.Join(name, "index.txt"))
+	r, err := zip.OpenReader(name + ".zip")
 	if err != nil {
-		return fmt.Errorf("error creating index.txt: %v", err)
+		if os.IsNotExist(err) {
+			return os.MkdirAll(name, 0755)
+		}
+		return fmt.Errorf("error opening %v.zip to resume: %v", name, err)
 	}
-	defer index.Close()
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(f.Name, 0755); err != nil {
+				return err
+			}
+			continue
+		}
 
-	urlCount := 1
+		if err := os.MkdirAll(filepath.Dir(f.Name), 0755); err != nil {
+			return err
+		}
 
+		src, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("error reading %v from %v.zip: %v", f.Name, name, err)
+		}
+		dst, err := os.Create(f.Name)
+		if err != nil {
+			src.Close()
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		dst.Close()
+		if err != nil {
+			return fmt.Errorf("error restoring %v: %v", f.Name, err)
+		}
+	}
+
+	return os.MkdirAll(name, 0755)
+}
+
+// nextHTMLIndex scans dir for existing N.html files and returns one past the
+// highest N found, so a resumed run's new files don't overwrite files a
+// prior session already wrote.
+func nextHTMLIndex(dir string) int {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 1
+	}
+
+	max := 0
+	for _, e := range entries {
+		n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".html"))
+		if err == nil && n > max {
+			max = n
+		}
+	}
+	return max + 1
+}
+
+// handleFileWarc fetches urls and writes them as a single gzip'd WARC file,
+// <name>.warc.gz: each record is its own independent gzip member, so a
+// resumed run can simply append a fresh warcinfo record plus this run's
+// request/response pairs rather than rewriting the file and losing whatever
+// a prior, interrupted run already wrote.
+func handleFileWarc(name string, urls []string, state *crawlState) error {
+	warcFile, err := os.OpenFile(name+".warc.gz", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening warc file: %v", err)
+	}
+	defer warcFile.Close()
+
+	if err := writeWarcInfo(warcFile, name); err != nil {
+		return fmt.Errorf("error writing warcinfo record: %v", err)
+	}
+
+	// Each request/response pair is written as its result arrives, rather
+	// than buffering every body in memory for the whole file until fetchAll
+	// returns.
+	onResult := func(res fetchResult) {
+		if res.Err != nil || res.Response == nil {
+			return
+		}
+		if err := writeWarcRequestResponse(warcFile, res); err != nil {
+			appLogger.Error("error writing warc record", Fields{"url": res.URL, "err": err.Error()})
+			atomic.AddInt64(&totalErrs, 1)
+		}
+	}
+
+	fetchAll(urls, state, name, onResult)
+
+	return nil
+}
+
+// fetchResult is the outcome of fetching a single URL: either a successful
+// response with its body read into memory, or an error.
+type fetchResult struct {
+	Seq        int
+	URL        string
+	Request    *http.Request
+	RawRequest []byte
+	Response   *http.Response
+	Body       []byte
+	Err        error
+	Attempts   int
+}
+
+// fetchJob is a URL that survived fetchAll's pre-filtering (not blank, not a
+// pdf link, not already done, not disallowed by robots.txt) and will
+// actually be fetched, paired with its already-parsed target so fetchAll
+// doesn't need to parse it again per goroutine.
+type fetchJob struct {
+	url    string
+	target *neturl.URL
+}
+
+// fetchAll concurrently fetches urls (skipping blanks, anything that looks
+// like a pdf link, anything state already has marked "done", and anything
+// robots.txt disallows), respecting -r in-flight requests at a time, and
+// returns one fetchResult per attempted URL in completion order. If
+// onResult is non-nil, it's called with each result (still holding its
+// body) as soon as that result is ready, and the body is then dropped from
+// the returned fetchResult so callers that persist it as it arrives don't
+// also need to hold every body in memory at once.
+func fetchAll(urls []string, state *crawlState, progressName string, onResult func(fetchResult)) []fetchResult {
 	var wg sync.WaitGroup
 	var mu sync.Mutex
+	var results []fetchResult
+	seq := 0
 
-	// Allows for aborting requests
-	tr := &http.Transport{}
-	client := &http.Client{Transport: tr}
+	client := &http.Client{Transport: &http.Transport{}}
 
 	// Queue for concurrent http requests
 	requestQueue := make(chan struct{}, *reqThreads)
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
+	// Filtered up front so the progress bar's total reflects urls that will
+	// actually be fetched, not the raw line count of the input file.
+	var jobs []fetchJob
+	for _, u := range urls {
+		if len(strings.TrimSpace(u)) <= 0 || strings.Contains(strings.ToLower(u), "pdf") {
+			continue
+		}
+		if !state.shouldFetch(u, *maxAttempts) {
+			continue
+		}
+
+		target, parseErr := neturl.Parse(u)
+		if parseErr == nil && !politenessCtl.allow(target) {
+			appLogger.Warn("skipping url disallowed by robots.txt", Fields{"url": u})
+			continue
+		}
+
+		jobs = append(jobs, fetchJob{url: u, target: target})
+	}
+
+	progress.setTotal(progressName, len(jobs))
+
+	for _, job := range jobs {
 		wg.Add(1)
-		go func(url string) {
+		go func(job fetchJob) {
 			defer wg.Done()
 
-			// Ignore pdf files
-			if len(strings.TrimSpace(url)) <= 0 || strings.Contains(strings.ToLower(url), "pdf") {
-				return
-			}
+			url := job.url
 
 			// Occupy spot in queue
 			requestQueue <- struct{}{}
+			defer func() { <-requestQueue }()
 
-			if !*quiet {
-				fmt.Printf("Getting %v\n", url)
+			if job.target != nil {
+				release := politenessCtl.acquire(job.target)
+				defer release()
 			}
 
-			request, err := http.NewRequest("GET", url, nil)
-			if err != nil {
-				logger.Println(err)
-				totalErrs++
-				return
+			// Skipped once the progress UI is active: it redraws bars in
+			// place via cursor-up escapes keyed to a tracked line count, and
+			// an interleaved print here would throw that off.
+			if !*quiet && progress == nil {
+				fmt.Printf("Getting %v\n", url)
 			}
 
-			c := make(chan error, 1)
-
-			go func() {
-				resp, err := client.Do(request)
-				if err == nil {
-					defer resp.Body.Close()
-
-					// Prevent race conditions
-					mu.Lock()
-					newFileName := fmt.Sprint(urlCount) + ".html"
-					urlCount++
-					total++
-					mu.Unlock()
-
-					newFile, err := os.Create(filepath.Join(name, newFileName))
-					if err != nil {
-						logger.Println(err)
-						totalErrs++
-						return
-					}
-					io.Copy(newFile, resp.Body)
-					newFile.Close()
-
-					index.WriteString(fmt.Sprintf("%v, %v\n", url, newFile.Name()))
-				}
-				c <- err
-			}()
-
-			// Fire off a timeout if request takes 10 seconds
-			timeout := make(chan struct{})
-			go func() {
-				time.Sleep(10 * time.Second)
-				timeout <- struct{}{}
-			}()
-
-			// Handle timeout or response - whichever happens first
-			select {
-			case <-timeout:
-				logger.Println(fmt.Errorf("timed out: %v", url))
-				fmt.Println("Aborting", url)
-				tr.CancelRequest(request)
-			case err = <-c:
-				if err != nil {
-					logger.Println(err)
-					totalErrs++
+			state.markInflight(url)
+			res := fetchOne(client, url)
+			if res.Err != nil {
+				state.markError(url)
+			} else {
+				httpStatus := 0
+				if res.Response != nil {
+					httpStatus = res.Response.StatusCode
 				}
+				state.markDone(url, httpStatus)
 			}
 
-			// Release spot in queue
-			<-requestQueue
-		}(scanner.Text())
+			progress.advance(progressName, len(res.Body))
+
+			mu.Lock()
+			res.Seq = seq
+			seq++
+			if onResult != nil {
+				onResult(res)
+				res.Body = nil
+			}
+			results = append(results, res)
+			if res.Err != nil {
+				atomic.AddInt64(&totalErrs, 1)
+			} else {
+				atomic.AddInt64(&total, 1)
+			}
+			mu.Unlock()
+		}(job)
 	}
 	wg.Wait()
 
-	// Create archive of html files
-	err = zipit(name, name+".zip")
+	return results
+}
+
+// fetchOne fetches url, retrying retryable failures (network errors, 429s,
+// 5xx responses) up to *retries times with exponential backoff, honoring
+// any Retry-After header the server sends.
+func fetchOne(client *http.Client, url string) fetchResult {
+	var res fetchResult
+	for attempt := 1; attempt <= *retries+1; attempt++ {
+		res = fetchOnce(client, url, attempt)
+		res.Attempts = attempt
+		if attempt > *retries || !retryable(res) {
+			break
+		}
+		time.Sleep(retryDelay(res, attempt, *retryBase, *retryCap))
+	}
+	return res
+}
+
+// fetchOnce performs a single GET request, aborting it once it takes
+// longer than timeoutThreshold seconds, and logs the outcome with
+// url/status/bytes/duration_ms/attempt fields.
+func fetchOnce(client *http.Client, url string, attempt int) fetchResult {
+	startedAt := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*timeoutThreshold)*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("error creating zip: %v", err)
+		appLogger.Error(err.Error(), Fields{"url": url, "attempt": attempt})
+		return fetchResult{URL: url, Err: err}
 	}
+	request.Header.Set("User-Agent", politenessCtl.userAgent)
 
-	err = os.RemoveAll(name)
+	rawReq, _ := httputil.DumpRequestOut(request, false)
+
+	resp, err := client.Do(request)
+	duration := time.Since(startedAt).Milliseconds()
 	if err != nil {
-		return fmt.Errorf("error deleting directory %v: %v", name, err)
+		if ctx.Err() == context.DeadlineExceeded {
+			appLogger.Warn("fetch timed out", Fields{"url": url, "attempt": attempt, "duration_ms": duration})
+		} else {
+			appLogger.Error(err.Error(), Fields{"url": url, "attempt": attempt, "duration_ms": duration})
+		}
+		return fetchResult{URL: url, Request: request, RawRequest: rawReq, Err: err}
 	}
+	defer resp.Body.Close()
 
-	return nil
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		appLogger.Error(err.Error(), Fields{"url": url, "status": resp.StatusCode, "attempt": attempt, "duration_ms": duration})
+		return fetchResult{URL: url, Request: request, RawRequest: rawReq, Response: resp, Err: err}
+	}
+
+	appLogger.Info("fetch complete", Fields{"url": url, "status": resp.StatusCode, "bytes": len(body), "attempt": attempt, "duration_ms": duration})
+	return fetchResult{URL: url, Request: request, RawRequest: rawReq, Response: resp, Body: body}
+}
+
+// retryable reports whether res represents a transient failure worth
+// retrying: a network/timeout error, a 429, or a 5xx response.
+func retryable(res fetchResult) bool {
+	if res.Err != nil {
+		return true
+	}
+	if res.Response == nil {
+		return false
+	}
+	return res.Response.StatusCode == http.StatusTooManyRequests || res.Response.StatusCode >= 500
+}
+
+// retryDelay computes how long to wait before the next attempt: the
+// response's Retry-After header if it sent one, otherwise exponential
+// backoff (base*2^attempt, capped at capDur) plus up to base worth of
+// jitter.
+func retryDelay(res fetchResult, attempt int, base, capDur time.Duration) time.Duration {
+	if res.Response != nil {
+		if ra := res.Response.Header.Get("Retry-After"); ra != "" {
+			if secs, err := strconv.Atoi(ra); err == nil {
+				return time.Duration(secs) * time.Second
+			}
+			if t, err := http.ParseTime(ra); err == nil {
+				if d := time.Until(t); d > 0 {
+					return d
+				}
+			}
+		}
+	}
+
+	d := base * time.Duration(int64(1)<<uint(attempt))
+	if d <= 0 || d > capDur {
+		d = capDur
+	}
+	return d + time.Duration(rand.Int63n(int64(base)+1))
 }
 
 func zipit(source, target string) error {
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		res  fetchResult
+		want bool
+	}{
+		{"network error", fetchResult{Err: errors.New("boom")}, true},
+		{"no response, no error", fetchResult{}, false},
+		{"429", fetchResult{Response: &http.Response{StatusCode: http.StatusTooManyRequests}}, true},
+		{"500", fetchResult{Response: &http.Response{StatusCode: 500}}, true},
+		{"503", fetchResult{Response: &http.Response{StatusCode: 503}}, true},
+		{"200", fetchResult{Response: &http.Response{StatusCode: 200}}, false},
+		{"404", fetchResult{Response: &http.Response{StatusCode: 404}}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := retryable(c.res); got != c.want {
+				t.Errorf("retryable(%+v) = %v, want %v", c.res, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelayHonorsRetryAfterSeconds(t *testing.T) {
+	res := fetchResult{Response: &http.Response{Header: http.Header{"Retry-After": []string{"5"}}}}
+
+	got := retryDelay(res, 1, 500*time.Millisecond, 30*time.Second)
+	if got != 5*time.Second {
+		t.Errorf("retryDelay = %v, want 5s", got)
+	}
+}
+
+func TestRetryDelayHonorsRetryAfterHTTPDate(t *testing.T) {
+	future := time.Now().Add(10 * time.Second).UTC()
+	res := fetchResult{Response: &http.Response{Header: http.Header{"Retry-After": []string{future.Format(http.TimeFormat)}}}}
+
+	got := retryDelay(res, 1, 500*time.Millisecond, 30*time.Second)
+	if got <= 0 || got > 10*time.Second {
+		t.Errorf("retryDelay = %v, want roughly up to 10s", got)
+	}
+}
+
+func TestRetryDelayFallsBackToExponentialBackoffCappedAtCapDur(t *testing.T) {
+	base := 500 * time.Millisecond
+	capDur := 2 * time.Second
+
+	got := retryDelay(fetchResult{}, 10, base, capDur)
+	if got < capDur || got > capDur+base {
+		t.Errorf("retryDelay = %v, want within [%v, %v]", got, capDur, capDur+base)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// robotsRules is the Disallow/Crawl-delay directives that apply to a
+// single User-Agent, parsed out of one host's robots.txt.
+type robotsRules struct {
+	disallow   []string
+	crawlDelay time.Duration
+}
+
+// allow reports whether path is permitted by these rules.
+func (r *robotsRules) allow(path string) bool {
+	for _, d := range r.disallow {
+		if d != "" && strings.HasPrefix(path, d) {
+			return false
+		}
+	}
+	return true
+}
+
+// hostLimiter enforces politeness for a single host: at most perHost
+// requests in flight at once, spaced at least delay (plus up to jitter)
+// apart, and informed by that host's robots.txt.
+type hostLimiter struct {
+	sem        chan struct{}
+	mu         sync.Mutex
+	lastReq    time.Time
+	delay      time.Duration
+	jitter     time.Duration
+	robots     *robotsRules
+	robotsOnce sync.Once
+}
+
+// acquire blocks until a request slot is free and the minimum delay since
+// the last request has elapsed, then returns a func to release the slot.
+func (hl *hostLimiter) acquire() func() {
+	hl.sem <- struct{}{}
+
+	hl.mu.Lock()
+	wait := hl.delay - time.Since(hl.lastReq)
+	if hl.jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(hl.jitter)))
+	}
+	if wait > 0 {
+		hl.mu.Unlock()
+		time.Sleep(wait)
+		hl.mu.Lock()
+	}
+	hl.lastReq = time.Now()
+	hl.mu.Unlock()
+
+	return func() { <-hl.sem }
+}
+
+// politeness coordinates one hostLimiter per host seen so far, fetching and
+// caching each host's robots.txt the first time it's contacted.
+type politeness struct {
+	mu           sync.Mutex
+	limiters     map[string]*hostLimiter
+	perHost      int
+	delay        time.Duration
+	jitter       time.Duration
+	userAgent    string
+	ignoreRobots bool
+	client       *http.Client
+}
+
+// newPoliteness returns a politeness controller. perHost caps in-flight
+// requests per host, delay/jitter space out requests to the same host, and
+// robots.txt is honored for userAgent unless ignoreRobots is set.
+func newPoliteness(perHost int, delay, jitter time.Duration, userAgent string, ignoreRobots bool) *politeness {
+	return &politeness{
+		limiters:     make(map[string]*hostLimiter),
+		perHost:      perHost,
+		delay:        delay,
+		jitter:       jitter,
+		userAgent:    userAgent,
+		ignoreRobots: ignoreRobots,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// limiterFor returns (creating if necessary) the hostLimiter for target's
+// host, fetching robots.txt for it on first contact. p.mu is only held long
+// enough to look up or insert the hostLimiter; the robots.txt fetch itself
+// happens outside that lock via hl.robotsOnce, so one host's first request
+// blocks only other goroutines hitting that same host, not every host.
+func (p *politeness) limiterFor(target *url.URL) *hostLimiter {
+	p.mu.Lock()
+	hl, ok := p.limiters[target.Host]
+	if !ok {
+		hl = &hostLimiter{sem: make(chan struct{}, p.perHost), delay: p.delay, jitter: p.jitter}
+		p.limiters[target.Host] = hl
+	}
+	p.mu.Unlock()
+
+	hl.robotsOnce.Do(func() {
+		if p.ignoreRobots {
+			return
+		}
+		hl.robots = p.fetchRobots(target)
+		if hl.robots != nil {
+			hl.mu.Lock()
+			if hl.robots.crawlDelay > hl.delay {
+				hl.delay = hl.robots.crawlDelay
+			}
+			hl.mu.Unlock()
+		}
+	})
+
+	return hl
+}
+
+// fetchRobots fetches and parses /robots.txt for target's host. Any
+// failure (no robots.txt, network error, non-200) is treated as "no
+// restrictions" rather than an error.
+func (p *politeness) fetchRobots(target *url.URL) *robotsRules {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s/robots.txt", target.Scheme, target.Host), nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("User-Agent", p.userAgent)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil
+	}
+
+	return parseRobots(string(body), p.userAgent)
+}
+
+// allow reports whether fetching target is permitted under its host's
+// cached robots.txt.
+func (p *politeness) allow(target *url.URL) bool {
+	if p.ignoreRobots {
+		return true
+	}
+	hl := p.limiterFor(target)
+	if hl.robots == nil {
+		return true
+	}
+	return hl.robots.allow(target.Path)
+}
+
+// acquire blocks until target's host has a free slot and its politeness
+// delay has elapsed, returning a func to call once the request completes.
+func (p *politeness) acquire(target *url.URL) func() {
+	return p.limiterFor(target).acquire()
+}
+
+// parseRobots extracts the Disallow and Crawl-delay directives that apply
+// to userAgent (matched on the part before any "/") from a robots.txt
+// body, falling back to the "*" group if there's no more specific match.
+func parseRobots(body, userAgent string) *robotsRules {
+	rules := make(map[string]*robotsRules)
+	agentToken := strings.ToLower(strings.SplitN(userAgent, "/", 2)[0])
+
+	var current []string
+	groupStarted := false
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		switch field {
+		case "user-agent":
+			if groupStarted {
+				current = nil
+				groupStarted = false
+			}
+			agent := strings.ToLower(value)
+			current = append(current, agent)
+			if _, ok := rules[agent]; !ok {
+				rules[agent] = &robotsRules{}
+			}
+		case "disallow":
+			groupStarted = true
+			for _, agent := range current {
+				rules[agent].disallow = append(rules[agent].disallow, value)
+			}
+		case "crawl-delay":
+			groupStarted = true
+			if secs, err := strconv.ParseFloat(value, 64); err == nil {
+				for _, agent := range current {
+					rules[agent].crawlDelay = time.Duration(secs * float64(time.Second))
+				}
+			}
+		}
+	}
+
+	if r, ok := rules[agentToken]; ok {
+		return r
+	}
+	return rules["*"]
+}
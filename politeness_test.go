@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRobotsMatchesExactAgentOverWildcard(t *testing.T) {
+	body := `User-agent: *
+Disallow: /private
+
+User-agent: webscraper
+Disallow: /only-for-us
+Crawl-delay: 2
+`
+	rules := parseRobots(body, "webscraper/1.0 (+https://example.com)")
+	if rules == nil {
+		t.Fatal("expected rules, got nil")
+	}
+	if rules.allow("/only-for-us/page") {
+		t.Error("expected /only-for-us to be disallowed")
+	}
+	if !rules.allow("/private/page") {
+		t.Error("expected /private to be allowed: it's only disallowed for '*', not the specific-agent group that matched")
+	}
+	if rules.crawlDelay != 2*time.Second {
+		t.Errorf("crawlDelay = %v, want 2s", rules.crawlDelay)
+	}
+}
+
+func TestParseRobotsFallsBackToWildcard(t *testing.T) {
+	body := `User-agent: *
+Disallow: /private
+`
+	rules := parseRobots(body, "webscraper/1.0")
+	if rules == nil {
+		t.Fatal("expected rules, got nil")
+	}
+	if rules.allow("/private/page") {
+		t.Error("expected /private to be disallowed under the wildcard group")
+	}
+	if !rules.allow("/public/page") {
+		t.Error("expected /public to be allowed")
+	}
+}
+
+func TestParseRobotsNoMatchingGroup(t *testing.T) {
+	body := `User-agent: othercrawler
+Disallow: /everything
+`
+	rules := parseRobots(body, "webscraper/1.0")
+	if rules != nil {
+		t.Errorf("expected no rules when neither the agent nor '*' has a group, got %+v", rules)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressBar tracks completed/total counts and bytes downloaded for one
+// input file (or, for the "TOTAL" bar, across all of them).
+type progressBar struct {
+	label     string
+	total     int
+	completed int
+	bytes     int64
+	startedAt time.Time
+}
+
+// progressManager renders one bar per input file currently being
+// processed, plus an aggregate "TOTAL" bar, redrawing in place as urls are
+// fetched. A nil *progressManager is always a safe no-op, so callers don't
+// need to guard every call behind the -progress flag.
+type progressManager struct {
+	mu        sync.Mutex
+	bars      map[string]*progressBar
+	order     []string
+	isTTY     bool
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// newProgressManager starts a progressManager that redraws its bars in the
+// background until close is called. On a non-TTY stdout it falls back to
+// printing a periodic text summary instead of cursor-repositioned bars.
+func newProgressManager() *progressManager {
+	pm := &progressManager{
+		bars:  make(map[string]*progressBar),
+		isTTY: isTerminal(os.Stdout),
+		stop:  make(chan struct{}),
+	}
+	go pm.run()
+	return pm
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// addFile registers a bar for fname with the given number of urls to fetch.
+func (pm *progressManager) addFile(fname string, total int) {
+	if pm == nil {
+		return
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.bars[fname] = &progressBar{label: fname, total: total, startedAt: time.Now()}
+	pm.order = append(pm.order, fname)
+}
+
+// setTotal sets fname's bar to the given total url count. Used once fetchAll
+// has filtered out blanks, pdf links, already-done urls, and anything
+// robots.txt disallows, so the bar reflects urls that will actually be
+// fetched rather than the input file's raw line count.
+func (pm *progressManager) setTotal(fname string, total int) {
+	if pm == nil {
+		return
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if b, ok := pm.bars[fname]; ok {
+		b.total = total
+	}
+}
+
+// advance records one more completed url (and its response size in bytes)
+// for fname.
+func (pm *progressManager) advance(fname string, n int) {
+	if pm == nil {
+		return
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	b, ok := pm.bars[fname]
+	if !ok {
+		return
+	}
+	b.completed++
+	b.bytes += int64(n)
+}
+
+// removeFile drops the bar for fname once it's fully processed.
+func (pm *progressManager) removeFile(fname string) {
+	if pm == nil {
+		return
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	delete(pm.bars, fname)
+	for i, n := range pm.order {
+		if n == fname {
+			pm.order = append(pm.order[:i], pm.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// close stops the background redraw loop after drawing one final frame.
+func (pm *progressManager) close() {
+	if pm == nil {
+		return
+	}
+	pm.closeOnce.Do(func() { close(pm.stop) })
+}
+
+func (pm *progressManager) run() {
+	interval := 200 * time.Millisecond
+	if !pm.isTTY {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastLines := 0
+	for {
+		select {
+		case <-pm.stop:
+			pm.render(&lastLines)
+			return
+		case <-ticker.C:
+			pm.render(&lastLines)
+		}
+	}
+}
+
+// render draws (or, on a non-TTY, prints) one line per active file plus an
+// aggregate TOTAL line.
+func (pm *progressManager) render(lastLines *int) {
+	pm.mu.Lock()
+	order := append([]string(nil), pm.order...)
+	bars := make(map[string]progressBar, len(pm.bars))
+	for k, v := range pm.bars {
+		bars[k] = *v
+	}
+	pm.mu.Unlock()
+
+	var agg progressBar
+	lines := make([]string, 0, len(order)+1)
+	for _, name := range order {
+		b, ok := bars[name]
+		if !ok {
+			continue
+		}
+		agg.completed += b.completed
+		agg.total += b.total
+		agg.bytes += b.bytes
+		lines = append(lines, formatProgressBar(b))
+	}
+	agg.label = "TOTAL"
+	lines = append(lines, formatProgressBar(agg))
+
+	if !pm.isTTY {
+		for _, l := range lines {
+			fmt.Println(l)
+		}
+		return
+	}
+
+	if *lastLines > 0 {
+		fmt.Printf("\x1b[%dA", *lastLines)
+	}
+	for _, l := range lines {
+		fmt.Printf("\x1b[2K%s\n", l)
+	}
+	*lastLines = len(lines)
+}
+
+// formatProgressBar renders a single [====    ] N/total (req/s, bytes) line.
+func formatProgressBar(b progressBar) string {
+	const width = 30
+
+	ratio := 0.0
+	if b.total > 0 {
+		ratio = float64(b.completed) / float64(b.total)
+	}
+	filled := int(ratio * width)
+	if filled > width {
+		filled = width
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+
+	rate := 0.0
+	if elapsed := time.Since(b.startedAt).Seconds(); elapsed > 0 {
+		rate = float64(b.completed) / elapsed
+	}
+
+	return fmt.Sprintf("%-20s [%s] %d/%d (%.1f req/s, %s)",
+		truncateLabel(b.label, 20), bar, b.completed, b.total, rate, humanBytes(b.bytes))
+}
+
+func truncateLabel(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+// humanBytes renders n bytes as e.g. "512B", "3.4KiB", "1.2MiB".
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
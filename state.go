@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// stateSaveInterval bounds how often crawlState rewrites its state file: at
+// most once per interval, rather than once per markInflight/markDone/
+// markError/setFile call. For an n-URL crawl that turns what would be
+// O(n) full-file rewrites into a small, bounded number of them.
+const stateSaveInterval = 2 * time.Second
+
+// urlStatus is the lifecycle state of a single queued URL.
+type urlStatus string
+
+const (
+	statusPending  urlStatus = "pending"
+	statusInflight urlStatus = "inflight"
+	statusDone     urlStatus = "done"
+	statusError    urlStatus = "error"
+)
+
+// urlRecord is the persisted record for a single URL within a crawlState.
+type urlRecord struct {
+	URL        string    `json:"url"`
+	Status     urlStatus `json:"status"`
+	HTTPStatus int       `json:"http_status,omitempty"`
+	File       string    `json:"file,omitempty"`
+	Attempts   int       `json:"attempts"`
+}
+
+// crawlState is the persistent, resumable progress for one input .txt
+// file, stored as newline-delimited JSON at <name>.state. handleFile
+// consults it before fetching a URL and updates it as requests complete, so
+// a crawl that's interrupted can be rerun without redoing finished work.
+type crawlState struct {
+	mu       sync.Mutex
+	path     string
+	entries  map[string]*urlRecord
+	order    []string
+	dirty    bool
+	lastSave time.Time
+}
+
+// loadCrawlState reads path if it exists, recovering any "inflight" entries
+// (left behind by a crawl that was killed mid-request) back to "pending",
+// and adds a fresh "pending" entry for every url that the file doesn't
+// already know about.
+func loadCrawlState(path string, urls []string) (*crawlState, error) {
+	cs := &crawlState{path: path, entries: make(map[string]*urlRecord)}
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var rec urlRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				continue
+			}
+			if rec.Status == statusInflight {
+				rec.Status = statusPending
+			}
+			entry := rec
+			cs.entries[rec.URL] = &entry
+			cs.order = append(cs.order, rec.URL)
+		}
+		scanErr := scanner.Err()
+		f.Close()
+		if scanErr != nil {
+			return nil, fmt.Errorf("error reading state file %v: %v", path, scanErr)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error opening state file %v: %v", path, err)
+	}
+
+	for _, u := range urls {
+		if _, ok := cs.entries[u]; !ok {
+			cs.entries[u] = &urlRecord{URL: u, Status: statusPending}
+			cs.order = append(cs.order, u)
+		}
+	}
+
+	cs.mu.Lock()
+	err := cs.flushLocked()
+	cs.mu.Unlock()
+	return cs, err
+}
+
+// shouldFetch reports whether url still needs to be (re)fetched: it's new or
+// pending, or it previously errored and hasn't exhausted maxAttempts.
+func (cs *crawlState) shouldFetch(url string, maxAttempts int) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	rec, ok := cs.entries[url]
+	if !ok {
+		return true
+	}
+	switch rec.Status {
+	case statusDone:
+		return false
+	case statusError:
+		return rec.Attempts < maxAttempts
+	default:
+		return true
+	}
+}
+
+// markInflight records that url is currently being fetched, so a crash
+// during the request is recovered as "pending" rather than lost.
+func (cs *crawlState) markInflight(url string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.entry(url).Status = statusInflight
+	cs.markDirty()
+}
+
+// markDone records a completed fetch and its HTTP status.
+func (cs *crawlState) markDone(url string, httpStatus int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	rec := cs.entry(url)
+	rec.Status = statusDone
+	rec.HTTPStatus = httpStatus
+	cs.markDirty()
+}
+
+// markError records a failed attempt and increments its attempt count.
+func (cs *crawlState) markError(url string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	rec := cs.entry(url)
+	rec.Status = statusError
+	rec.Attempts++
+	cs.markDirty()
+}
+
+// setFile records the output filename a completed fetch was written to.
+func (cs *crawlState) setFile(url, file string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.entry(url).File = file
+	cs.markDirty()
+}
+
+// entry returns the urlRecord for url, creating a pending one if it's not
+// already tracked. Callers must hold cs.mu.
+func (cs *crawlState) entry(url string) *urlRecord {
+	rec, ok := cs.entries[url]
+	if !ok {
+		rec = &urlRecord{URL: url, Status: statusPending}
+		cs.entries[url] = rec
+		cs.order = append(cs.order, url)
+	}
+	return rec
+}
+
+// markDirty flags the in-memory entries as needing a flush and, if it's
+// been at least stateSaveInterval since the last one, flushes right away.
+// Otherwise the flush is left for the next markDirty call (or Flush) once
+// the interval has passed. Callers must hold cs.mu.
+func (cs *crawlState) markDirty() {
+	cs.dirty = true
+	if time.Since(cs.lastSave) >= stateSaveInterval {
+		cs.flushLocked()
+	}
+}
+
+// Flush writes any pending changes to the state file immediately. Callers
+// (handleFile, in particular) should defer this so a crawl's final results
+// are never left unsaved behind the stateSaveInterval debounce.
+func (cs *crawlState) Flush() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if !cs.dirty {
+		return nil
+	}
+	return cs.flushLocked()
+}
+
+// flushLocked rewrites the state file from the current in-memory entries
+// via a write-then-rename so a killed process never leaves a truncated file
+// behind. Callers must hold cs.mu.
+func (cs *crawlState) flushLocked() error {
+	tmp := cs.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("error writing state file %v: %v", cs.path, err)
+	}
+
+	enc := json.NewEncoder(f)
+	for _, u := range cs.order {
+		if err := enc.Encode(cs.entries[u]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, cs.path); err != nil {
+		return err
+	}
+	cs.dirty = false
+	cs.lastSave = time.Now()
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCrawlStateAddsPendingEntriesForNewURLs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.state")
+
+	cs, err := loadCrawlState(path, []string{"http://a.example/", "http://b.example/"})
+	if err != nil {
+		t.Fatalf("loadCrawlState: %v", err)
+	}
+	if !cs.shouldFetch("http://a.example/", 3) {
+		t.Error("expected a fresh URL to need fetching")
+	}
+}
+
+func TestCrawlStateDoneURLIsNotRefetched(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.state")
+	url := "http://a.example/"
+
+	cs, err := loadCrawlState(path, []string{url})
+	if err != nil {
+		t.Fatalf("loadCrawlState: %v", err)
+	}
+
+	cs.markInflight(url)
+	cs.markDone(url, 200)
+	if cs.shouldFetch(url, 3) {
+		t.Error("expected a done URL not to need refetching")
+	}
+}
+
+func TestCrawlStateErrorRetriesUntilMaxAttempts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.state")
+	url := "http://a.example/"
+
+	cs, err := loadCrawlState(path, []string{url})
+	if err != nil {
+		t.Fatalf("loadCrawlState: %v", err)
+	}
+
+	cs.markError(url)
+	if !cs.shouldFetch(url, 2) {
+		t.Error("expected a URL below maxAttempts to still need fetching")
+	}
+
+	cs.markError(url)
+	if cs.shouldFetch(url, 2) {
+		t.Error("expected a URL at maxAttempts to stop being refetched")
+	}
+}
+
+func TestLoadCrawlStateRecoversInflightAsPending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.state")
+	url := "http://a.example/"
+
+	cs, err := loadCrawlState(path, []string{url})
+	if err != nil {
+		t.Fatalf("loadCrawlState: %v", err)
+	}
+	cs.markInflight(url)
+	if err := cs.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	// Reload from the same path, as a rerun after a kill mid-request would.
+	resumed, err := loadCrawlState(path, []string{url})
+	if err != nil {
+		t.Fatalf("loadCrawlState (resume): %v", err)
+	}
+	if !resumed.shouldFetch(url, 3) {
+		t.Error("expected a url left inflight by a killed run to be retried on resume")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httputil"
+	"time"
+)
+
+// newWarcRecordID returns a freshly generated WARC-Record-ID, formatted as a
+// urn:uuid per the WARC 1.0 spec.
+func newWarcRecordID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// writeWarcRecord writes a single WARC record as its own gzip member, so
+// that replay tools can seek to and decompress one record at a time.
+func writeWarcRecord(w io.Writer, recordType, targetURI string, payload []byte) error {
+	header := fmt.Sprintf(
+		"WARC/1.0\r\n"+
+			"WARC-Type: %s\r\n"+
+			"WARC-Record-ID: %s\r\n"+
+			"WARC-Date: %s\r\n",
+		recordType, newWarcRecordID(), time.Now().UTC().Format(time.RFC3339))
+
+	if targetURI != "" {
+		header += fmt.Sprintf("WARC-Target-URI: %s\r\n", targetURI)
+	}
+
+	switch recordType {
+	case "request":
+		header += "Content-Type: application/http; msgtype=request\r\n"
+	case "response":
+		header += "Content-Type: application/http; msgtype=response\r\n"
+	default:
+		header += "Content-Type: application/warc-fields\r\n"
+	}
+	header += fmt.Sprintf("Content-Length: %d\r\n\r\n", len(payload))
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write([]byte(header)); err != nil {
+		return err
+	}
+	if _, err := gz.Write(payload); err != nil {
+		return err
+	}
+	if _, err := gz.Write([]byte("\r\n\r\n")); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// writeWarcInfo writes the leading warcinfo record identifying the crawler
+// that produced this file.
+func writeWarcInfo(w io.Writer, source string) error {
+	fields := fmt.Sprintf(
+		"software: webscraper\r\n"+
+			"format: WARC File Format 1.0\r\n"+
+			"source: %s\r\n", source)
+	return writeWarcRecord(w, "warcinfo", "", []byte(fields))
+}
+
+// writeWarcRequestResponse appends the request and response record pair for
+// a single fetched URL.
+func writeWarcRequestResponse(w io.Writer, res fetchResult) error {
+	if err := writeWarcRecord(w, "request", res.URL, res.RawRequest); err != nil {
+		return err
+	}
+
+	rawResp, err := dumpWarcResponse(res)
+	if err != nil {
+		return err
+	}
+	return writeWarcRecord(w, "response", res.URL, rawResp)
+}
+
+// dumpWarcResponse reconstructs the raw status line, headers and body of a
+// fetchResult whose body has already been read into memory.
+func dumpWarcResponse(res fetchResult) ([]byte, error) {
+	res.Response.Body = ioutil.NopCloser(bytes.NewReader(res.Body))
+	raw, err := httputil.DumpResponse(res.Response, true)
+	res.Response.Body = ioutil.NopCloser(bytes.NewReader(res.Body))
+	return raw, err
+}